@@ -0,0 +1,62 @@
+package database
+
+import (
+	pb "github.com/autograde/quickfeed/ag"
+	"github.com/autograde/quickfeed/idpool"
+	"github.com/jinzhu/gorm"
+)
+
+// GormDB implements the Database interface using a GORM backend.
+type GormDB struct {
+	conn *gorm.DB
+
+	// submissionIDs and reviewIDs allocate application-managed, never-
+	// reused primary keys for submissions and reviews. See idpool.
+	submissionIDs *idpool.Pool
+	reviewIDs     *idpool.Pool
+}
+
+// NewGormDB creates a new GormDB backed by conn, migrating the schema,
+// backfilling attempt numbers on submissions that predate attempt
+// numbering, and initializing the id pools that the submission and review
+// subsystems depend on.
+func NewGormDB(conn *gorm.DB) (*GormDB, error) {
+	// The key_pool table itself is migrated by idpool.NewPool below,
+	// which owns that (unexported) model.
+	if err := conn.AutoMigrate(
+		&pb.User{},
+		&pb.Group{},
+		&pb.Course{},
+		&pb.Assignment{},
+		&pb.Submission{},
+		&pb.Review{},
+		&ReviewCriterion{},
+		&SubmissionStatusChange{},
+	).Error; err != nil {
+		return nil, err
+	}
+
+	// Guards against two concurrent CreateSubmission calls computing the
+	// same AttemptNumber for the same assignment and student/group: the
+	// losing insert fails with a constraint violation instead of
+	// silently duplicating an attempt.
+	if err := conn.Model(&pb.Submission{}).
+		AddUniqueIndex("idx_submission_attempt", "assignment_id", "user_id", "group_id", "attempt_number").Error; err != nil {
+		return nil, err
+	}
+
+	if err := migrateSubmissionAttemptNumbers(conn); err != nil {
+		return nil, err
+	}
+
+	submissionIDs, reviewIDs, err := newSubmissionAndReviewPools(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GormDB{
+		conn:          conn,
+		submissionIDs: submissionIDs,
+		reviewIDs:     reviewIDs,
+	}, nil
+}
@@ -1,14 +1,151 @@
 package database
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	pb "github.com/autograde/quickfeed/ag"
 	"github.com/jinzhu/gorm"
 )
 
-// CreateSubmission creates a new submission record or updates the most
-// recent submission, as defined by the provided submissionQuery.
-// The submissionQuery must always specify the assignment, and may specify the ID of
-// either an individual student or a group, but not both.
+// maxAttemptNumberRetries bounds how many times CreateSubmission tries
+// attempt-number allocation, the first try included, when it keeps losing
+// races to concurrent submissions for the same assignment and
+// student/group.
+const maxAttemptNumberRetries = 10
+
+// attemptNumberRetryBackoff is the base delay between retries, scaled
+// linearly by attempt count, giving a concurrent SQLite writer time to
+// release its lock instead of immediately re-colliding with it.
+const attemptNumberRetryBackoff = 5 * time.Millisecond
+
+// isRetryableAttemptNumberErr reports whether err is the kind of failure a
+// losing CreateSubmission transaction can see when it races another one
+// for the same attempt number: a unique/primary-key constraint violation,
+// across the dialects GormDB is deployed against, or - under SQLite, which
+// serializes writers at the connection/process level rather than via row
+// locks - the writer finding the database busy or locked.
+func isRetryableAttemptNumberErr(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "UNIQUE constraint") ||
+		strings.Contains(msg, "duplicate key") ||
+		strings.Contains(msg, "database is locked") ||
+		strings.Contains(msg, "SQLITE_BUSY")
+}
+
+// SubmissionOrderColumn is a column submissions may be sorted by. It is a
+// closed set rather than a free-form string so a client-supplied sort key
+// can never be used to inject arbitrary SQL into the ORDER BY clause.
+type SubmissionOrderColumn string
+
+// Columns accepted by SubmissionQueryOptions.OrderBy.
+const (
+	OrderByCreatedAt SubmissionOrderColumn = "created_at"
+	OrderByUpdatedAt SubmissionOrderColumn = "updated_at"
+	OrderByScore     SubmissionOrderColumn = "score"
+)
+
+// SubmissionOrderDirection is the sort direction for SubmissionQueryOptions.OrderBy.
+type SubmissionOrderDirection string
+
+// Directions accepted by SubmissionQueryOptions.OrderDirection.
+const (
+	OrderAsc  SubmissionOrderDirection = "asc"
+	OrderDesc SubmissionOrderDirection = "desc"
+)
+
+// SubmissionQueryOptions refines a submission query with pagination,
+// ordering, and time-window filtering. The zero value matches everything
+// and imposes no limit or ordering.
+type SubmissionQueryOptions struct {
+	// Offset is the number of matching submissions to skip.
+	Offset int
+	// Limit caps the number of submissions returned. Zero means no limit.
+	Limit int
+	// OrderBy, if non-empty, sorts results by this column; must be one
+	// of the OrderBy* constants.
+	OrderBy SubmissionOrderColumn
+	// OrderDirection controls ascending vs descending order for OrderBy.
+	// Defaults to OrderAsc if empty or unrecognized.
+	OrderDirection SubmissionOrderDirection
+	// From, if non-zero, restricts results to submissions created at or
+	// after this time.
+	From time.Time
+	// To, if non-zero, restricts results to submissions created at or
+	// before this time.
+	To time.Time
+	// Status, if non-nil, restricts results to submissions with the
+	// given status. A separate field is needed since the zero value of
+	// pb.Submission_Status is itself a valid status and cannot be used
+	// as a sentinel inside query.
+	Status *pb.Submission_Status
+	// Total, if non-nil, is set to the number of submissions matching
+	// the query and filters, before Offset/Limit are applied.
+	Total *int64
+}
+
+// SubmissionLoadOptions selects which associations to preload alongside a
+// submission query, avoiding the N+1 queries that callers needing
+// BuildInfo, Scores, User, Group, or Assignment would otherwise incur. The
+// zero value preloads nothing.
+type SubmissionLoadOptions struct {
+	WithReviews    bool
+	WithBuildInfo  bool
+	WithScores     bool
+	WithUser       bool
+	WithGroup      bool
+	WithAssignment bool
+}
+
+// fullSubmissionLoadOptions preloads every association a submission can
+// carry; it backs GetSubmissionFull.
+var fullSubmissionLoadOptions = &SubmissionLoadOptions{
+	WithReviews:    true,
+	WithBuildInfo:  true,
+	WithScores:     true,
+	WithUser:       true,
+	WithGroup:      true,
+	WithAssignment: true,
+}
+
+// preload applies the associations selected by opts to m. A nil opts
+// preloads nothing.
+func (opts *SubmissionLoadOptions) preload(m *gorm.DB) *gorm.DB {
+	if opts == nil {
+		return m
+	}
+	if opts.WithReviews {
+		m = m.Preload("Reviews")
+	}
+	if opts.WithBuildInfo {
+		m = m.Preload("BuildInfo")
+	}
+	if opts.WithScores {
+		m = m.Preload("Scores")
+	}
+	if opts.WithUser {
+		m = m.Preload("User")
+	}
+	if opts.WithGroup {
+		m = m.Preload("Group")
+	}
+	if opts.WithAssignment {
+		m = m.Preload("Assignment")
+	}
+	return m
+}
+
+// CreateSubmission creates a new submission record as the next attempt for
+// the given assignment and student/group, as defined by the provided
+// submission. The submission must always specify the assignment, and may
+// specify the ID of either an individual student or a group, but not both.
+//
+// Submissions are append-only: every call inserts a new row and never
+// mutates a prior attempt, so that earlier build results, scores, and test
+// output are preserved. AttemptNumber is set to one greater than the
+// highest AttemptNumber previously recorded for the same assignment and
+// student/group, starting at 1 for the first attempt.
 func (db *GormDB) CreateSubmission(submission *pb.Submission) error {
 	// Primary key must be greater than 0.
 	if submission.AssignmentID < 1 {
@@ -46,40 +183,94 @@ func (db *GormDB) CreateSubmission(submission *pb.Submission) error {
 		return gorm.ErrRecordNotFound
 	}
 
-	// Make a new submission struct for the database query to check
-	// whether a submission record for the given lab and user/group
-	// already exists. We cannot reuse the incoming submission
-	// because the query would attempt to match all the test result
-	// fields as well.
+	// Make a new submission struct for the database query to find the
+	// previous attempt, if any, for the given assignment and
+	// student/group. We cannot reuse the incoming submission because
+	// the query would attempt to match all the test result fields as
+	// well.
 	query := &pb.Submission{
 		AssignmentID: submission.GetAssignmentID(),
 		UserID:       submission.GetUserID(),
 		GroupID:      submission.GetGroupID(),
 	}
 
-	// We want the last record as there can be multiple submissions
-	// for the same student/group and lab in the database.
-	if err := db.conn.Last(query, query).Error; err != nil && err != gorm.ErrRecordNotFound {
-		return err
+	if submission.SubmittedAt.IsZero() {
+		submission.SubmittedAt = time.Now()
+	}
+
+	// Reading the previous attempt and inserting the next one must be
+	// atomic, or two concurrent submissions for the same assignment and
+	// student/group can compute the same AttemptNumber. The unique index
+	// on (assignment_id, user_id, group_id, attempt_number) turns that
+	// race into a constraint violation on the losing transaction, which
+	// we retry with a freshly read AttemptNumber.
+	var err error
+	for attempt := 0; attempt < maxAttemptNumberRetries; attempt++ {
+		err = db.Transaction(func(tx *gorm.DB) error {
+			var previous pb.Submission
+			switch err := tx.Where(query).Order("attempt_number desc").First(&previous).Error; err {
+			case nil:
+				submission.AttemptNumber = previous.AttemptNumber + 1
+			case gorm.ErrRecordNotFound:
+				submission.AttemptNumber = 1
+			default:
+				return err
+			}
+
+			// Assign the primary key ourselves rather than letting
+			// GORM auto-increment it: GORM reuses the highest ID
+			// after a row is deleted, which would collide with any
+			// ID already handed out to a caller (e.g. in a gRPC
+			// response sent before the row was pruned).
+			id, err := db.submissionIDs.Next()
+			if err != nil {
+				return err
+			}
+			submission.ID = id
+
+			return tx.Create(submission).Error
+		})
+		if err == nil || !isRetryableAttemptNumberErr(err) {
+			return err
+		}
+		time.Sleep(time.Duration(attempt+1) * attemptNumberRetryBackoff)
+	}
+	return fmt.Errorf("database: giving up after %d attempt-number conflicts for assignment %d: %w",
+		maxAttemptNumberRetries, submission.AssignmentID, err)
+}
+
+// GetSubmission fetches the latest attempt matching the query, preloading
+// the associations selected by opts. A nil opts preloads nothing.
+func (db *GormDB) GetSubmission(query *pb.Submission, opts *SubmissionLoadOptions) (*pb.Submission, error) {
+	var submission pb.Submission
+	m := opts.preload(db.conn)
+	if err := m.Where(query).Order("attempt_number desc").First(&submission).Error; err != nil {
+		return nil, err
 	}
+	return &submission, nil
+}
 
-	// If a submission for the given assignment and student/group already exists, update it.
-	// Otherwise create a new submission record
-	var labSubmission pb.Submission
-	err := db.conn.Where(query).Assign(submission).FirstOrCreate(&labSubmission).Error
+// GetSubmissionFull fetches the latest attempt matching the query,
+// preloading every association, for use by the code-review UI.
+func (db *GormDB) GetSubmissionFull(query *pb.Submission) (*pb.Submission, error) {
+	return db.GetSubmission(query, fullSubmissionLoadOptions)
+}
 
-	if submission.GetScore() == 0 {
-		// GORM doesn't update zero value fields, unless forced:
-		err = db.conn.Model(submission).Where(query).Updates(map[string]interface{}{"Score": 0}).Error
+// GetSubmissionAttempts returns every attempt recorded for the given
+// assignment and student/group, ordered from first to most recent.
+func (db *GormDB) GetSubmissionAttempts(query *pb.Submission) ([]*pb.Submission, error) {
+	var submissions []*pb.Submission
+	if err := db.conn.Where(query).Order("attempt_number asc").Find(&submissions).Error; err != nil {
+		return nil, err
 	}
-	submission.ID = labSubmission.GetID()
-	return err
+	return submissions, nil
 }
 
-// GetSubmission fetches a submission record.
-func (db *GormDB) GetSubmission(query *pb.Submission) (*pb.Submission, error) {
+// GetSubmissionAttempt fetches a single, specific attempt for the given
+// assignment and student/group, for point-in-time review.
+func (db *GormDB) GetSubmissionAttempt(query *pb.Submission, attempt uint32) (*pb.Submission, error) {
 	var submission pb.Submission
-	if err := db.conn.Preload("Reviews").Where(query).Last(&submission).Error; err != nil {
+	if err := db.conn.Where(query).Where("attempt_number = ?", attempt).First(&submission).Error; err != nil {
 		return nil, err
 	}
 	return &submission, nil
@@ -87,7 +278,7 @@ func (db *GormDB) GetSubmission(query *pb.Submission) (*pb.Submission, error) {
 
 // GetLastSubmissions returns all submissions for the active assignment for the given course.
 // The query may specify both UserID and GroupID to fetch both user and group submissions.
-func (db *GormDB) GetLastSubmissions(courseID uint64, query *pb.Submission) ([]*pb.Submission, error) {
+func (db *GormDB) GetLastSubmissions(courseID uint64, query *pb.Submission, loadOpts *SubmissionLoadOptions) ([]*pb.Submission, error) {
 	var course pb.Course
 	if err := db.conn.Preload("Assignments").First(&course, courseID).Error; err != nil {
 		return nil, err
@@ -96,7 +287,7 @@ func (db *GormDB) GetLastSubmissions(courseID uint64, query *pb.Submission) ([]*
 	var latestSubs []*pb.Submission
 	for _, a := range course.Assignments {
 		query.AssignmentID = a.GetID()
-		temp, err := db.GetSubmission(query)
+		temp, err := db.GetSubmission(query, loadOpts)
 		if err != nil {
 			if err == gorm.ErrRecordNotFound {
 				continue
@@ -109,9 +300,61 @@ func (db *GormDB) GetLastSubmissions(courseID uint64, query *pb.Submission) ([]*
 }
 
 // GetSubmissions returns all submissions matching the query.
-func (db *GormDB) GetSubmissions(query *pb.Submission) ([]*pb.Submission, error) {
+func (db *GormDB) GetSubmissions(query *pb.Submission, loadOpts *SubmissionLoadOptions) ([]*pb.Submission, error) {
+	return db.QuerySubmissions(query, nil, loadOpts)
+}
+
+// QuerySubmissions returns submissions matching query, refined by opts,
+// preloading the associations selected by loadOpts. It supports pagination
+// (opts.Offset/opts.Limit), ordering (opts.OrderBy), a created-at time
+// window (opts.From/opts.To), and a status filter (opts.Status). If
+// opts.Total is non-nil, it is set to the total number of matching
+// submissions before Offset/Limit are applied. This allows callers such as
+// a teacher dashboard to page through submissions without loading and
+// filtering the entire table in Go.
+func (db *GormDB) QuerySubmissions(query *pb.Submission, opts *SubmissionQueryOptions, loadOpts *SubmissionLoadOptions) ([]*pb.Submission, error) {
+	m := loadOpts.preload(db.conn).Where(query)
+	if opts != nil {
+		if !opts.From.IsZero() {
+			m = m.Where("created_at >= ?", opts.From)
+		}
+		if !opts.To.IsZero() {
+			m = m.Where("created_at <= ?", opts.To)
+		}
+		if opts.Status != nil {
+			m = m.Where("status = ?", *opts.Status)
+		}
+	}
+
+	if opts != nil && opts.Total != nil {
+		if err := m.Model(&pb.Submission{}).Count(opts.Total).Error; err != nil {
+			return nil, err
+		}
+	}
+
+	if opts != nil {
+		if opts.OrderBy != "" {
+			switch opts.OrderBy {
+			case OrderByCreatedAt, OrderByUpdatedAt, OrderByScore:
+				dir := opts.OrderDirection
+				if dir != OrderAsc && dir != OrderDesc {
+					dir = OrderAsc
+				}
+				m = m.Order(string(opts.OrderBy) + " " + string(dir))
+			default:
+				return nil, fmt.Errorf("database: invalid submission order column %q", opts.OrderBy)
+			}
+		}
+		if opts.Limit > 0 {
+			m = m.Limit(opts.Limit)
+		}
+		if opts.Offset > 0 {
+			m = m.Offset(opts.Offset)
+		}
+	}
+
 	var submissions []*pb.Submission
-	if err := db.conn.Find(&submissions, &query).Error; err != nil {
+	if err := m.Find(&submissions).Error; err != nil {
 		return nil, err
 	}
 	return submissions, nil
@@ -122,35 +365,177 @@ func (db *GormDB) UpdateSubmission(query *pb.Submission) error {
 	return db.conn.Save(query).Error
 }
 
-// UpdateSubmissions approves and/or releases all submissions that have score
-// equal or above the provided score for the given assignment ID
-func (db *GormDB) UpdateSubmissions(courseID uint64, query *pb.Submission) error {
-	return db.conn.
-		Model(query).
+// UpdateSubmissionsResult reports the submissions a bulk update affected.
+type UpdateSubmissionsResult struct {
+	AffectedIDs []uint64
+}
+
+// PreviewUpdateSubmissions returns the IDs of the submissions that
+// UpdateSubmissions would touch for the same selector (assignment ID and
+// minimum score), without mutating anything. This lets a teacher see what
+// an "approve all >= 80" click will affect before committing to it.
+func (db *GormDB) PreviewUpdateSubmissions(courseID uint64, query *pb.Submission) ([]uint64, error) {
+	var ids []uint64
+	err := db.conn.Model(&pb.Submission{}).
 		Where("assignment_id = ?", query.AssignmentID).
 		Where("score >= ?", query.Score).
-		Updates(&pb.Submission{
-			Status:   query.Status,
-			Released: query.Released,
-		}).Error
+		Pluck("id", &ids).Error
+	return ids, err
 }
 
-// CreateReview creates a new submission review
-func (db *GormDB) CreateReview(query *pb.Review) error {
-	return db.conn.Create(query).Error
+// UpdateSubmissions approves and/or releases all submissions that have
+// score equal or above the provided score for the given assignment ID.
+// The selection, mutation, and audit trail all run inside a single
+// transaction: each affected submission gets a companion
+// SubmissionStatusChange row recording its old and new status/released
+// fields, who made the change, and why, so the change can be reviewed or
+// undone later with RevertSubmissionStatusChange.
+func (db *GormDB) UpdateSubmissions(courseID uint64, query *pb.Submission, changedByUserID uint64, reason string) (*UpdateSubmissionsResult, error) {
+	result := &UpdateSubmissionsResult{}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		var submissions []*pb.Submission
+		if err := tx.Where("assignment_id = ?", query.AssignmentID).
+			Where("score >= ?", query.Score).
+			Find(&submissions).Error; err != nil {
+			return err
+		}
+
+		for _, s := range submissions {
+			change := &SubmissionStatusChange{
+				SubmissionID:    s.GetID(),
+				OldStatus:       s.GetStatus(),
+				NewStatus:       query.GetStatus(),
+				OldReleased:     s.GetReleased(),
+				NewReleased:     query.GetReleased(),
+				ChangedByUserID: changedByUserID,
+				ChangedAt:       time.Now(),
+				Reason:          reason,
+			}
+			if err := tx.Create(change).Error; err != nil {
+				return err
+			}
+			// A column map, not a struct, is required here: GORM's
+			// struct-based Updates skips zero-valued fields, which
+			// would silently drop an un-release (Released=false) or
+			// a zero-valued target Status while the audit row above
+			// still claims it was applied.
+			if err := tx.Model(s).Updates(map[string]interface{}{
+				"status":   query.Status,
+				"released": query.Released,
+			}).Error; err != nil {
+				return err
+			}
+			result.AffectedIDs = append(result.AffectedIDs, s.GetID())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
-// UpdateReview updates feedback text, review and ready status
+// RevertSubmissionStatusChange atomically restores a submission's
+// status/released fields to what they were before the
+// SubmissionStatusChange with the given ID was applied.
+func (db *GormDB) RevertSubmissionStatusChange(changeID uint64) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var change SubmissionStatusChange
+		if err := tx.First(&change, changeID).Error; err != nil {
+			return err
+		}
+		return tx.Model(&pb.Submission{}).
+			Where("id = ?", change.SubmissionID).
+			Updates(map[string]interface{}{
+				"status":   change.OldStatus,
+				"released": change.OldReleased,
+			}).Error
+	})
+}
+
+// CreateReview creates a new submission review and seeds it with one
+// ReviewCriterion per GradingCriterion across all of the GradingBenchmarks
+// defined on the submission's assignment, so that grading starts from a
+// rubric rather than free form. MaxPoints is taken from GradingCriterion,
+// which is where the proto models points; GradingBenchmark itself only
+// groups criteria under a heading and carries no points of its own.
+func (db *GormDB) CreateReview(review *pb.Review) error {
+	id, err := db.reviewIDs.Next()
+	if err != nil {
+		return err
+	}
+	review.ID = id
+
+	return db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(review).Error; err != nil {
+			return err
+		}
+
+		var submission pb.Submission
+		if err := tx.First(&submission, review.SubmissionID).Error; err != nil {
+			return err
+		}
+		var assignment pb.Assignment
+		if err := tx.Preload("GradingBenchmarks").Preload("GradingBenchmarks.Criteria").
+			First(&assignment, submission.AssignmentID).Error; err != nil {
+			return err
+		}
+
+		for _, b := range assignment.GradingBenchmarks {
+			for _, c := range b.Criteria {
+				criterion := &ReviewCriterion{
+					ReviewID:    review.ID,
+					BenchmarkID: b.GetID(),
+					CriterionID: c.GetID(),
+					MaxPoints:   c.GetPoints(),
+				}
+				if err := tx.Create(criterion).Error; err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// UpdateReview updates feedback text, review and ready status. Score is always
+// recomputed server-side from the review's ReviewCriterion rows as
+// sum(Points) / sum(MaxPoints) * 100; any Score supplied by the client is
+// ignored. Ready=true is rejected with ErrCriteriaNotGraded unless every
+// criterion has been graded.
 func (db *GormDB) UpdateReview(query *pb.Review) error {
+	criteria, err := db.GetReviewCriteria(query.ID)
+	if err != nil {
+		return err
+	}
+
+	var points, maxPoints uint32
+	for _, c := range criteria {
+		if query.Ready && c.Grade == nil {
+			return ErrCriteriaNotGraded
+		}
+		points += c.Points
+		maxPoints += c.MaxPoints
+	}
+
+	var score uint32
+	if maxPoints > 0 {
+		score = points * 100 / maxPoints
+	}
+
+	// A column map, not a struct, is required here: GORM's struct-based
+	// Update skips zero-valued fields, which would silently keep a
+	// review Ready=true forever (Ready can never be unset) and keep a
+	// stale Score when the rubric recomputes to exactly 0.
 	return db.conn.Model(query).Where(&pb.Review{
 		ID:           query.ID,
 		SubmissionID: query.SubmissionID,
 		ReviewerID:   query.ReviewerID,
-	}).Update(&pb.Review{
-		Feedback: query.Feedback,
-		Review:   query.Review,
-		Ready:    query.Ready,
-		Score:    query.Score,
+	}).Updates(map[string]interface{}{
+		"feedback": query.Feedback,
+		"review":   query.Review,
+		"ready":    query.Ready,
+		"score":    score,
 	}).Error
 }
 
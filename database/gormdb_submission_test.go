@@ -0,0 +1,91 @@
+package database
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+
+	pb "github.com/autograde/quickfeed/ag"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+)
+
+// newTestGormDB returns a GormDB backed by a fresh sqlite file in t's
+// temporary directory, along with the user and group-less assignment
+// fixtures that CreateSubmission's existence checks require. The
+// assignment belongs to a course fixture that is created but not returned.
+func newTestGormDB(t *testing.T) (*GormDB, *pb.User, *pb.Assignment) {
+	t.Helper()
+	conn, err := gorm.Open("sqlite3", filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to open test database: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	db, err := NewGormDB(conn)
+	if err != nil {
+		t.Fatalf("NewGormDB: %v", err)
+	}
+
+	user := &pb.User{}
+	if err := db.conn.Create(user).Error; err != nil {
+		t.Fatalf("failed to create test user: %v", err)
+	}
+	course := &pb.Course{}
+	if err := db.conn.Create(course).Error; err != nil {
+		t.Fatalf("failed to create test course: %v", err)
+	}
+	assignment := &pb.Assignment{CourseID: course.ID}
+	if err := db.conn.Create(assignment).Error; err != nil {
+		t.Fatalf("failed to create test assignment: %v", err)
+	}
+	return db, user, assignment
+}
+
+func TestCreateSubmissionAttemptNumbering(t *testing.T) {
+	db, user, assignment := newTestGormDB(t)
+
+	for want := uint32(1); want <= 3; want++ {
+		submission := &pb.Submission{AssignmentID: assignment.ID, UserID: user.ID}
+		if err := db.CreateSubmission(submission); err != nil {
+			t.Fatalf("CreateSubmission: %v", err)
+		}
+		if submission.AttemptNumber != want {
+			t.Errorf("AttemptNumber = %d, want %d", submission.AttemptNumber, want)
+		}
+	}
+}
+
+func TestCreateSubmissionConcurrentAttemptNumbering(t *testing.T) {
+	db, user, assignment := newTestGormDB(t)
+
+	const numSubmissions = 10
+	var wg sync.WaitGroup
+	attempts := make([]uint32, numSubmissions)
+	errs := make([]error, numSubmissions)
+
+	for i := 0; i < numSubmissions; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			submission := &pb.Submission{AssignmentID: assignment.ID, UserID: user.ID}
+			errs[i] = db.CreateSubmission(submission)
+			attempts[i] = submission.AttemptNumber
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[uint32]bool, numSubmissions)
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("CreateSubmission: %v", err)
+		}
+		if seen[attempts[i]] {
+			t.Fatalf("AttemptNumber %d was assigned to more than one concurrent submission", attempts[i])
+		}
+		seen[attempts[i]] = true
+	}
+	if len(seen) != numSubmissions {
+		t.Fatalf("got %d distinct attempt numbers, want %d", len(seen), numSubmissions)
+	}
+}
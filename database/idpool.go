@@ -0,0 +1,22 @@
+package database
+
+import (
+	"github.com/autograde/quickfeed/idpool"
+	"github.com/jinzhu/gorm"
+)
+
+// newSubmissionAndReviewPools constructs the id pools backing
+// GormDB.submissionIDs and GormDB.reviewIDs, recovering each from its
+// key_pool row (or MAX(id) on the submissions/reviews tables if no such
+// row exists yet). It is called once from NewGormDB.
+func newSubmissionAndReviewPools(conn *gorm.DB) (submissionIDs, reviewIDs *idpool.Pool, err error) {
+	submissionIDs, err = idpool.NewPool(conn, "submissions")
+	if err != nil {
+		return nil, nil, err
+	}
+	reviewIDs, err = idpool.NewPool(conn, "reviews")
+	if err != nil {
+		return nil, nil, err
+	}
+	return submissionIDs, reviewIDs, nil
+}
@@ -0,0 +1,14 @@
+package database
+
+import "github.com/jinzhu/gorm"
+
+// migrateSubmissionAttemptNumbers backfills AttemptNumber=1 on existing
+// submission rows created before attempt numbering was introduced. It is
+// idempotent: rows that already carry a non-zero AttemptNumber are left
+// untouched. Rows whose attempt_number column was added by AutoMigrate hold
+// NULL rather than 0, so both are treated as missing.
+func migrateSubmissionAttemptNumbers(db *gorm.DB) error {
+	return db.Table("submissions").
+		Where("attempt_number = 0 OR attempt_number IS NULL").
+		Update("attempt_number", 1).Error
+}
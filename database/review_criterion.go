@@ -0,0 +1,64 @@
+package database
+
+import "errors"
+
+// ErrCriteriaNotGraded is returned by UpdateReview when a review is marked
+// Ready but one or more of its ReviewCriterion rows have not yet been
+// graded.
+var ErrCriteriaNotGraded = errors.New("database: review has ungraded criteria")
+
+// Grade is a reviewer's verdict on a single ReviewCriterion.
+type Grade int32
+
+const (
+	GradeFailed Grade = iota
+	GradePassed
+)
+
+// ReviewCriterion is a single rubric line item attached to a review. It is
+// copied from a GradingCriterion on the assignment's GradingBenchmarks by
+// CreateReview, and graded independently by the reviewer via
+// UpdateReviewCriterion. A review may only be marked Ready once every one
+// of its criteria has a non-nil Grade.
+type ReviewCriterion struct {
+	ID uint64 `gorm:"primary_key"`
+	// ReviewID is the review this criterion was graded as part of.
+	ReviewID uint64
+	// BenchmarkID is the GradingBenchmark the source GradingCriterion
+	// belongs to, for grouping criteria by heading.
+	BenchmarkID uint64
+	// CriterionID is the GradingCriterion this row was copied from.
+	CriterionID uint64
+	Points      uint32
+	MaxPoints   uint32
+	Grade       *Grade
+	Comment     string
+}
+
+// GetReviewCriteria returns every ReviewCriterion attached to the given review.
+func (db *GormDB) GetReviewCriteria(reviewID uint64) ([]*ReviewCriterion, error) {
+	var criteria []*ReviewCriterion
+	if err := db.conn.Where(&ReviewCriterion{ReviewID: reviewID}).Find(&criteria).Error; err != nil {
+		return nil, err
+	}
+	return criteria, nil
+}
+
+// UpdateReviewCriterion records a reviewer's points, grade, and comment for
+// a single rubric criterion. points is clamped to [0, MaxPoints] so that
+// UpdateReview's points/MaxPoints*100 aggregation can never exceed 100.
+func (db *GormDB) UpdateReviewCriterion(criterionID uint64, points uint32, grade Grade, comment string) error {
+	var criterion ReviewCriterion
+	if err := db.conn.First(&criterion, criterionID).Error; err != nil {
+		return err
+	}
+	if points > criterion.MaxPoints {
+		points = criterion.MaxPoints
+	}
+
+	return db.conn.Model(&ReviewCriterion{}).Where("id = ?", criterionID).Updates(map[string]interface{}{
+		"points":  points,
+		"grade":   grade,
+		"comment": comment,
+	}).Error
+}
@@ -0,0 +1,24 @@
+package database
+
+import (
+	"time"
+
+	pb "github.com/autograde/quickfeed/ag"
+)
+
+// SubmissionStatusChange is an audit record of a single bulk-grading
+// mutation applied to a submission's status/released fields. It is
+// written by UpdateSubmissions alongside the mutation it describes, so
+// that the change has a who/what/when/why trail and can be undone with
+// RevertSubmissionStatusChange.
+type SubmissionStatusChange struct {
+	ID              uint64 `gorm:"primary_key"`
+	SubmissionID    uint64
+	OldStatus       pb.Submission_Status
+	NewStatus       pb.Submission_Status
+	OldReleased     bool
+	NewReleased     bool
+	ChangedByUserID uint64
+	ChangedAt       time.Time
+	Reason          string
+}
@@ -0,0 +1,17 @@
+package database
+
+import "github.com/jinzhu/gorm"
+
+// Transaction runs fn within a database transaction, committing if fn
+// returns nil and rolling back otherwise.
+func (db *GormDB) Transaction(fn func(tx *gorm.DB) error) error {
+	tx := db.conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit().Error
+}
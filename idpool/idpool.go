@@ -0,0 +1,134 @@
+// Package idpool provides application-managed primary key allocation for
+// tables where GORM's default auto-increment behavior is unsafe. GORM
+// reuses the highest previously-issued ID once the row holding it is
+// deleted, which silently collides with any ID a caller may have held on
+// to (e.g. a submission or review ID already returned in a gRPC response).
+// A Pool hands out IDs that are never reused, regardless of deletions.
+package idpool
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/jinzhu/gorm"
+)
+
+// reserveSize is the number of IDs reserved from the database, and
+// buffered in memory, per refill.
+const reserveSize = 50
+
+// keyPool is the backing row for a single table's ID counter.
+type keyPool struct {
+	Table  string `gorm:"primary_key"`
+	NextID uint64
+}
+
+// TableName overrides GORM's default pluralization so the table is named
+// key_pool rather than key_pools.
+func (keyPool) TableName() string {
+	return "key_pool"
+}
+
+// Pool allocates monotonically increasing, never-reused IDs for a single
+// table. A small batch of IDs is reserved from the key_pool table at a
+// time and buffered in memory, so most calls to Next do not hit the
+// database.
+type Pool struct {
+	mu       sync.Mutex
+	conn     *gorm.DB
+	table    string
+	next     uint64 // next ID to hand out
+	reserved uint64 // IDs below this value have been reserved in the database
+}
+
+// NewPool returns a Pool for the given table, migrating the key_pool table
+// that backs it if it does not already exist. If the table has no
+// key_pool row yet, the pool is seeded from MAX(id) over the table so
+// that recovery is correct even on a database that predates idpool.
+func NewPool(conn *gorm.DB, table string) (*Pool, error) {
+	if err := conn.AutoMigrate(&keyPool{}).Error; err != nil {
+		return nil, err
+	}
+
+	p := &Pool{conn: conn, table: table}
+	if err := p.recover(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// recover seeds the pool's in-memory counters from the key_pool row for
+// its table, creating that row from the table's current MAX(id) if it
+// does not exist yet.
+func (p *Pool) recover() error {
+	var kp keyPool
+	switch err := p.conn.Where(&keyPool{Table: p.table}).First(&kp).Error; err {
+	case nil:
+		p.next = kp.NextID
+		p.reserved = kp.NextID
+		return nil
+	case gorm.ErrRecordNotFound:
+		var maxID uint64
+		if err := p.conn.Table(p.table).Select("COALESCE(MAX(id), 0)").Row().Scan(&maxID); err != nil {
+			return err
+		}
+		p.next = maxID + 1
+		p.reserved = maxID + 1
+		return p.conn.Create(&keyPool{Table: p.table, NextID: p.next}).Error
+	default:
+		return err
+	}
+}
+
+// Next returns the next unused ID for the pool's table.
+func (p *Pool) Next() (uint64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.next >= p.reserved {
+		if err := p.refill(); err != nil {
+			return 0, err
+		}
+	}
+	id := p.next
+	p.next++
+	return id, nil
+}
+
+// refill reserves the next batch of IDs by advancing the key_pool row for
+// this table by reserveSize. The increment is computed by the database
+// from the row's current value (next_id = next_id + reserveSize) inside a
+// transaction, rather than by writing back a value computed from the
+// Pool's cached p.reserved: multiple Pool instances (in this process or
+// another) sharing the same database must each see the other's reservations,
+// or they will hand out overlapping IDs.
+func (p *Pool) refill() error {
+	tx := p.conn.Begin()
+	if tx.Error != nil {
+		return tx.Error
+	}
+
+	res := tx.Model(&keyPool{}).Where(&keyPool{Table: p.table}).
+		Update("next_id", gorm.Expr("next_id + ?", reserveSize))
+	if res.Error != nil {
+		tx.Rollback()
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		tx.Rollback()
+		return fmt.Errorf("idpool: no key_pool row for table %q", p.table)
+	}
+
+	var kp keyPool
+	if err := tx.Where(&keyPool{Table: p.table}).First(&kp).Error; err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		return err
+	}
+
+	p.reserved = kp.NextID
+	p.next = p.reserved - reserveSize
+	return nil
+}